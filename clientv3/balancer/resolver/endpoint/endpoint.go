@@ -16,16 +16,33 @@
 package endpoint
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/resolver"
 )
 
 const (
 	scheme = "endpoint"
+
+	// srvPrefix marks an endpoint as a DNS SRV lookup name, e.g.
+	// "dns+srv://_etcd-client-ssl._tcp.example.com", rather than a literal endpoint.
+	srvPrefix = "dns+srv://"
+
+	// minSRVInterval and maxSRVInterval bound how often the SRV watch re-resolves.
+	// net.Resolver doesn't surface the SRV record TTL, so the watch does NOT honor
+	// it; it re-resolves on the fixed minSRVInterval cadence in steady state and
+	// backs off toward maxSRVInterval only while lookups are failing.
+	minSRVInterval = 30 * time.Second
+	maxSRVInterval = 5 * time.Minute
 )
 
 var (
@@ -37,25 +54,31 @@ var (
 func init() {
 	bldr = &builder{
 		clientResolvers: make(map[string]*Resolver),
+		refCounts:       make(map[string]int),
 	}
 	resolver.Register(bldr)
 }
 
 type builder struct {
 	clientResolvers map[string]*Resolver
+	refCounts       map[string]int
 	sync.RWMutex
 }
 
-// Build creates or reuses an etcd resolver for the etcd cluster name identified by the authority part of the target.
-func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOption) (resolver.Resolver, error) {
+// Build creates or reuses an etcd resolver for the etcd cluster name identified by the
+// authority part of the target. Each Build call must be matched by a Close on the
+// returned resolver; the underlying Resolver is only torn down once its use count
+// drops to zero, so concurrent dials sharing a clientId don't tear down state out
+// from under one another.
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
 	if len(target.Authority) < 1 {
 		return nil, fmt.Errorf("'etcd' target scheme requires non-empty authority identifying etcd cluster being routed to")
 	}
-	r := b.getResolver(target.Authority)
+	r := b.acquireResolver(target.Authority)
+	r.Lock()
 	r.cc = cc
-	if r.addrs != nil {
-		r.NewAddress(r.addrs)
-	}
+	r.Unlock()
+	r.updateState()
 	return r, nil
 }
 
@@ -74,16 +97,61 @@ func (b *builder) getResolver(clientId string) *Resolver {
 	return r
 }
 
+// acquireResolver returns the resolver for clientId, creating it if necessary, and
+// increments its use count. Each call must be paired with a releaseResolver (done via
+// Resolver.Close).
+func (b *builder) acquireResolver(clientId string) *Resolver {
+	b.Lock()
+	defer b.Unlock()
+	r, ok := b.clientResolvers[clientId]
+	if !ok {
+		r = &Resolver{clientId: clientId}
+		b.clientResolvers[clientId] = r
+	}
+	b.refCounts[clientId]++
+	return r
+}
+
+// releaseResolver decrements the use count for clientId, removing it from the
+// registry once no more Builds are holding it. It reports whether this call was the
+// one that dropped the count to zero, so the caller can tear down resolver state
+// (e.g. a background SRV watch) exactly once, only when it's truly no longer in use.
+// A release of a resolver that is no longer the one registered for its clientId (e.g.
+// after unregisterResolver) leaves the registry untouched and reports false.
+func (b *builder) releaseResolver(r *Resolver) bool {
+	clientId := r.clientId
+	b.Lock()
+	defer b.Unlock()
+	if b.clientResolvers[clientId] != r {
+		return false
+	}
+	b.refCounts[clientId]--
+	if b.refCounts[clientId] <= 0 {
+		delete(b.refCounts, clientId)
+		delete(b.clientResolvers, clientId)
+		return true
+	}
+	return false
+}
+
 func (b *builder) addResolver(r *Resolver) {
 	bldr.Lock()
 	bldr.clientResolvers[r.clientId] = r
 	bldr.Unlock()
 }
 
-func (b *builder) removeResolver(r *Resolver) {
-	bldr.Lock()
-	delete(bldr.clientResolvers, r.clientId)
-	bldr.Unlock()
+// unregisterResolver forcibly removes clientId from the registry regardless of its
+// use count, stopping any background watch owned by the resolver it discards so it
+// can't leak a goroutine now that nothing can Close() it.
+func (b *builder) unregisterResolver(clientId string) {
+	b.Lock()
+	r := b.clientResolvers[clientId]
+	delete(b.clientResolvers, clientId)
+	delete(b.refCounts, clientId)
+	b.Unlock()
+	if r != nil {
+		r.stopSRVWatch()
+	}
 }
 
 func (r *builder) Scheme() string {
@@ -95,11 +163,28 @@ func EndpointResolver(clientId string) *Resolver {
 	return bldr.getResolver(clientId)
 }
 
+// UnregisterResolver forcibly removes the resolver for clientId, regardless of how
+// many Builds are still holding a reference to it. It's intended for tests and for
+// dynamic-tenancy use cases that need to guarantee a clean slate for a reused
+// clientId.
+func UnregisterResolver(clientId string) {
+	bldr.unregisterResolver(clientId)
+}
+
 // Resolver provides a resolver for a single etcd cluster, identified by name.
 type Resolver struct {
 	clientId string
 	cc       resolver.ClientConn
 	addrs    []resolver.Address
+	srvAddrs []resolver.Address
+	scJSON   string
+
+	srvCancel     context.CancelFunc
+	srvResolveNow chan struct{}
+	// srvLookup, if set, is used by watchSRV instead of lookupSRV. It exists so
+	// tests can exercise the watch goroutine's lifecycle without hitting real DNS.
+	srvLookup func(ctx context.Context, name string) ([]resolver.Address, error)
+
 	sync.RWMutex
 }
 
@@ -110,40 +195,336 @@ func (r *Resolver) InitialAddrs(addrs []resolver.Address) {
 	r.Unlock()
 }
 
+// InitialServiceConfig sets the initial gRPC service config (as JSON, in the format
+// accepted by grpc's service config resolution) that will be pushed to the ClientConn
+// alongside the resolved addresses. This should be called before dialing. The service
+// config may be updated after the dial using SetServiceConfig.
+func (r *Resolver) InitialServiceConfig(scJSON string) {
+	r.Lock()
+	r.scJSON = scJSON
+	r.Unlock()
+}
+
 // InitialEndpoints sets the initial endpoints to for the resolver.
 // This should be called before dialing. The endpoints may be updated after the dial using NewAddress.
-// At least one endpoint is required.
+// At least one endpoint is required. An endpoint of the form "dns+srv://<service>._tcp.<domain>"
+// (e.g. "dns+srv://_etcd-client-ssl._tcp.example.com") starts a background DNS SRV watch instead of
+// being treated as a literal endpoint; at most one such entry is supported.
 func (r *Resolver) InitialEndpoints(eps []string) error {
 	if len(eps) < 1 {
 		return fmt.Errorf("At least one endpoint is required, but got: %v", eps)
 	}
-	r.InitialAddrs(epsToAddrs(eps...))
+	statics, srvName, err := splitSRVEndpoints(eps)
+	if err != nil {
+		return err
+	}
+	r.InitialAddrs(epsToAddrs(statics...))
+	if srvName != "" {
+		r.startSRVWatch(srvName)
+	}
+	return nil
+}
+
+// splitSRVEndpoints separates literal endpoints from a single "dns+srv://" lookup name,
+// if present.
+func splitSRVEndpoints(eps []string) (statics []string, srvName string, err error) {
+	for _, ep := range eps {
+		if !strings.HasPrefix(ep, srvPrefix) {
+			statics = append(statics, ep)
+			continue
+		}
+		if srvName != "" {
+			return nil, "", fmt.Errorf("at most one %s endpoint is supported, got %q and %q", srvPrefix, srvName, ep)
+		}
+		srvName = strings.TrimPrefix(ep, srvPrefix)
+	}
+	return statics, srvName, nil
+}
+
+// startSRVWatch begins a background goroutine that periodically resolves the SRV
+// records for name (e.g. "_etcd-client-ssl._tcp.example.com"), merging the results
+// into the resolver's address set and calling UpdateState whenever the set changes.
+// Any previously running watch is stopped first. The goroutine is stopped by Close.
+func (r *Resolver) startSRVWatch(name string) {
+	r.stopSRVWatch()
+
+	r.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.srvCancel = cancel
+	resolveNow := make(chan struct{}, 1)
+	r.srvResolveNow = resolveNow
+	r.Unlock()
+
+	go r.watchSRV(ctx, name, resolveNow)
+}
+
+// stopSRVWatch cancels any running SRV watch goroutine started by startSRVWatch. It
+// is a no-op if no watch is running.
+func (r *Resolver) stopSRVWatch() {
+	r.Lock()
+	if r.srvCancel != nil {
+		r.srvCancel()
+		r.srvCancel = nil
+	}
+	r.Unlock()
+}
+
+func (r *Resolver) watchSRV(ctx context.Context, name string, resolveNow chan struct{}) {
+	r.RLock()
+	lookup := r.srvLookup
+	r.RUnlock()
+	if lookup == nil {
+		lookup = lookupSRV
+	}
+
+	// See the minSRVInterval/maxSRVInterval doc comment: this intentionally does not
+	// honor the record TTL, since net.Resolver doesn't expose it.
+	interval := minSRVInterval
+	for {
+		addrs, err := lookup(ctx, name)
+		switch {
+		case err == nil:
+			r.setSRVAddrs(addrs)
+			interval = minSRVInterval
+		case interval < maxSRVInterval:
+			interval *= 2
+			if interval > maxSRVInterval {
+				interval = maxSRVInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-resolveNow:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *Resolver) setSRVAddrs(addrs []resolver.Address) {
+	r.Lock()
+	r.srvAddrs = addrs
+	r.Unlock()
+	r.updateState()
+}
+
+// lookupSRV resolves name as a raw SRV query (e.g. "_etcd-client-ssl._tcp.example.com")
+// and converts the results into resolver addresses, carrying each record's Priority and
+// Weight in Address.Attributes.
+func lookupSRV(ctx context.Context, name string) ([]resolver.Address, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]resolver.Address, 0, len(srvs))
+	for _, s := range srvs {
+		addrs = append(addrs, srvToAddr(s))
+	}
+	return addrs, nil
+}
+
+// srvToAddr converts a single SRV record into a resolver.Address, carrying its
+// Priority and Weight in Address.Attributes.
+func srvToAddr(s *net.SRV) resolver.Address {
+	host := strings.TrimSuffix(s.Target, ".")
+	return resolver.Address{
+		Addr: net.JoinHostPort(host, strconv.Itoa(int(s.Port))),
+		Attributes: attributes.New(
+			"priority", strconv.Itoa(int(s.Priority)),
+			"weight", strconv.Itoa(int(s.Weight)),
+		),
+	}
+}
+
+// Attributes carries optional per-endpoint metadata that a companion balancer can use
+// for locality-aware routing or per-member credential presentation, e.g. preferring a
+// local member over a remote one while still being able to reach it if needed. This
+// package only carries these values on the resolved addresses; it does not act on them.
+type Attributes struct {
+	// ServerName is the TLS ServerName (SNI / hostname verification) to use when
+	// dialing this specific endpoint.
+	ServerName string
+	// Region (or zone) identifies the locality of this endpoint.
+	Region string
+	// Weight is this endpoint's selection weight relative to others.
+	Weight uint32
+	// PerRPCCredentials, if set, are the credentials to present on RPCs routed to
+	// this endpoint.
+	PerRPCCredentials credentials.PerRPCCredentials
+}
+
+// attrsKey is the key under which an endpoint's Attributes are packed into its
+// resolver.Address.Attributes.
+type attrsKey struct{}
+
+// AttributesFromAddress returns the Attributes packed onto addr by
+// InitialEndpointsWithAttrs or UpdateEndpoints, if any.
+func AttributesFromAddress(addr resolver.Address) (Attributes, bool) {
+	v := addr.Attributes.Value(attrsKey{})
+	if v == nil {
+		return Attributes{}, false
+	}
+	a, ok := v.(Attributes)
+	return a, ok
+}
+
+// InitialEndpointsWithAttrs sets the initial endpoints for the resolver, each carrying
+// optional Attributes. This should be called before dialing. The endpoints may be
+// updated after the dial using UpdateEndpoints. At least one endpoint is required.
+func (r *Resolver) InitialEndpointsWithAttrs(eps map[string]Attributes) error {
+	if len(eps) < 1 {
+		return fmt.Errorf("At least one endpoint is required, but got: %v", eps)
+	}
+	r.InitialAddrs(addrsWithAttrs(eps))
 	return nil
 }
 
+// UpdateEndpoints updates the resolver's endpoints, each carrying optional
+// Attributes. See InitialEndpointsWithAttrs.
+func (r *Resolver) UpdateEndpoints(eps map[string]Attributes) {
+	r.NewAddress(addrsWithAttrs(eps))
+}
+
+func addrsWithAttrs(eps map[string]Attributes) []resolver.Address {
+	addrs := make([]resolver.Address, 0, len(eps))
+	for ep, a := range eps {
+		addr := addrForEndpoint(ep)
+		if addr.Attributes == nil {
+			addr.Attributes = attributes.New(attrsKey{}, a)
+		} else {
+			addr.Attributes = addr.Attributes.WithValues(attrsKey{}, a)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 // TODO: use balancer.epsToAddrs
 func epsToAddrs(eps ...string) (addrs []resolver.Address) {
 	addrs = make([]resolver.Address, 0, len(eps))
 	for _, ep := range eps {
-		addrs = append(addrs, resolver.Address{Addr: ep})
+		addrs = append(addrs, addrForEndpoint(ep))
 	}
 	return addrs
 }
 
+// addrForEndpoint splits any query-string metadata off ep (e.g.
+// "https://10.0.0.1:2379?weight=10&zone=us-east-1a") and promotes it into the
+// resulting Address's Attributes, leaving Addr set to the bare endpoint.
+func addrForEndpoint(ep string) resolver.Address {
+	base, attrs := splitEndpointAttrs(ep)
+	addr := resolver.Address{Addr: base}
+	if len(attrs) > 0 {
+		addr.Attributes = attrsFromMap(attrs)
+	}
+	return addr
+}
+
+// attrsFromMap packs a string-keyed attribute map into grpc resolver.Address
+// Attributes, for consumption by a companion balancer.
+func attrsFromMap(m map[string]string) *attributes.Attributes {
+	if len(m) == 0 {
+		return nil
+	}
+	kvs := make([]interface{}, 0, len(m)*2)
+	for k, v := range m {
+		kvs = append(kvs, k, v)
+	}
+	return attributes.New(kvs...)
+}
+
+// splitEndpointAttrs splits ep's query string (if any) off into an attribute
+// map, returning the bare endpoint and the parsed attributes.
+func splitEndpointAttrs(ep string) (string, map[string]string) {
+	i := strings.IndexByte(ep, '?')
+	if i < 0 {
+		return ep, nil
+	}
+	base, rawQuery := ep[:i], ep[i+1:]
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ep, nil
+	}
+	return base, flattenQuery(q)
+}
+
+func flattenQuery(q url.Values) map[string]string {
+	if len(q) == 0 {
+		return nil
+	}
+	attrs := make(map[string]string, len(q))
+	for k, v := range q {
+		if len(v) > 0 {
+			attrs[k] = v[0]
+		}
+	}
+	return attrs
+}
+
 // NewAddress updates the addresses of the resolver.
 func (r *Resolver) NewAddress(addrs []resolver.Address) {
 	r.Lock()
 	r.addrs = addrs
 	r.Unlock()
-	if r.cc != nil {
-		r.cc.NewAddress(addrs)
+	r.updateState()
+}
+
+// SetServiceConfig updates the gRPC service config pushed to the ClientConn and
+// immediately triggers an update so it takes effect.
+func (r *Resolver) SetServiceConfig(scJSON string) {
+	r.Lock()
+	r.scJSON = scJSON
+	r.Unlock()
+	r.updateState()
+}
+
+// updateState pushes the resolver's current address set and service config to the
+// ClientConn via the grpc resolver.State API, replacing the deprecated NewAddress
+// call path. The ClientConn is invoked outside of r's lock so a slow or reentrant
+// UpdateState call can't block other Resolver operations (Close, ResolveNow,
+// concurrent NewAddress) or deadlock against r's non-reentrant mutex.
+func (r *Resolver) updateState() {
+	r.RLock()
+	cc := r.cc
+	addrs := append(append([]resolver.Address{}, r.addrs...), r.srvAddrs...)
+	scJSON := r.scJSON
+	r.RUnlock()
+	if cc == nil {
+		return
 	}
+	state := resolver.State{Addresses: addrs}
+	if scJSON != "" {
+		state.ServiceConfig = cc.ParseServiceConfig(scJSON)
+	}
+	// The returned error only reflects whether grpc accepted this particular
+	// state (e.g. malformed service config); there's nothing more for us to do
+	// with it here since the next change to addrs/scJSON will just push again.
+	_ = cc.UpdateState(state)
 }
 
-func (*Resolver) ResolveNow(o resolver.ResolveNowOption) {}
+// ResolveNow triggers an immediate re-resolution. For a resolver with an active DNS
+// SRV watch, this requests an immediate re-lookup instead of waiting for the next
+// scheduled interval.
+func (r *Resolver) ResolveNow(o resolver.ResolveNowOptions) {
+	r.RLock()
+	resolveNow := r.srvResolveNow
+	r.RUnlock()
+	if resolveNow == nil {
+		return
+	}
+	select {
+	case resolveNow <- struct{}{}:
+	default:
+	}
+}
 
+// Close releases this Build's reference to the resolver. The underlying Resolver,
+// and any background SRV watch it owns, is only torn down once every other
+// concurrent Build for the same clientId has also closed.
 func (r *Resolver) Close() {
-	bldr.removeResolver(r)
+	if bldr.releaseResolver(r) {
+		r.stopSRVWatch()
+	}
 }
 
 // Target constructs a endpoint target with current resolver's clientId.
@@ -163,6 +544,9 @@ func IsTarget(target string) bool {
 
 // Parse endpoint parses a endpoint of the form (http|https)://<host>*|(unix|unixs)://<path>) and returns a
 // protocol ('tcp' or 'unix'), host (or filepath if a unix socket) and scheme (http, https, unix, unixs).
+// A query string on an endpoint with a scheme (used to carry per-endpoint attributes, see ParseTarget) is
+// accepted and ignored here, since url.Parse separates it from Host/Path on its own. An endpoint without
+// "://" is returned unchanged as host, query string included.
 func ParseEndpoint(endpoint string) (proto string, host string, scheme string) {
 	proto = "tcp"
 	host = endpoint
@@ -185,16 +569,23 @@ func ParseEndpoint(endpoint string) (proto string, host string, scheme string) {
 	return proto, host, scheme
 }
 
-// ParseTarget parses a endpoint://<clientId>/<endpoint> string and returns the parsed clientId and endpoint.
+// ParseTarget parses a endpoint://<clientId>/<endpoint> string as an RFC 3986 URI and returns the
+// parsed clientId, endpoint and, if present, a map of per-endpoint attributes encoded in the target's
+// query string, e.g. "endpoint://c1/https://10.0.0.1:2379?weight=10&zone=us-east-1a" yields clientId
+// "c1", endpoint "https://10.0.0.1:2379" and attrs {"weight": "10", "zone": "us-east-1a"}.
 // If the target is malformed, an error is returned.
-func ParseTarget(target string) (string, string, error) {
-	noPrefix := strings.TrimPrefix(target, targetPrefix)
-	if noPrefix == target {
-		return "", "", fmt.Errorf("malformed target, %s prefix is required: %s", targetPrefix, target)
+func ParseTarget(target string) (clientId string, endpoint string, attrs map[string]string, err error) {
+	if !strings.HasPrefix(target, targetPrefix) {
+		return "", "", nil, fmt.Errorf("malformed target, %s prefix is required: %s", targetPrefix, target)
+	}
+	u, uerr := url.Parse(target)
+	if uerr != nil {
+		return "", "", nil, fmt.Errorf("malformed target, %s://<clientId>/<endpoint>: %v", scheme, uerr)
 	}
-	parts := strings.SplitN(noPrefix, "/", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("malformed target, expected %s://<clientId>/<endpoint>, but got %s", scheme, target)
+	clientId = u.Host
+	endpoint = strings.TrimPrefix(u.Path, "/")
+	if clientId == "" || endpoint == "" {
+		return "", "", nil, fmt.Errorf("malformed target, expected %s://<clientId>/<endpoint>, but got %s", scheme, target)
 	}
-	return parts[0], parts[1], nil
+	return clientId, endpoint, flattenQuery(u.Query()), nil
 }
@@ -0,0 +1,366 @@
+// Copyright 2018 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoint
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		wantClient string
+		wantEp     string
+		wantAttrs  map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "plain endpoint",
+			target:     "endpoint://c1/127.0.0.1:2379",
+			wantClient: "c1",
+			wantEp:     "127.0.0.1:2379",
+		},
+		{
+			name:       "endpoint with query attrs",
+			target:     "endpoint://c1/https://10.0.0.1:2379?weight=10&zone=us-east-1a",
+			wantClient: "c1",
+			wantEp:     "https://10.0.0.1:2379",
+			wantAttrs:  map[string]string{"weight": "10", "zone": "us-east-1a"},
+		},
+		{
+			name:    "missing prefix",
+			target:  "127.0.0.1:2379",
+			wantErr: true,
+		},
+		{
+			name:    "missing endpoint",
+			target:  "endpoint://c1/",
+			wantErr: true,
+		},
+		{
+			name:    "missing clientId",
+			target:  "endpoint:///127.0.0.1:2379",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientId, ep, attrs, err := ParseTarget(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTarget(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if clientId != tt.wantClient || ep != tt.wantEp {
+				t.Fatalf("ParseTarget(%q) = (%q, %q), want (%q, %q)", tt.target, clientId, ep, tt.wantClient, tt.wantEp)
+			}
+			if !reflect.DeepEqual(attrs, tt.wantAttrs) {
+				t.Fatalf("ParseTarget(%q) attrs = %v, want %v", tt.target, attrs, tt.wantAttrs)
+			}
+		})
+	}
+}
+
+func TestAddrForEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		ep       string
+		wantAddr string
+		wantAttr map[string]string
+	}{
+		{
+			name:     "no query string",
+			ep:       "127.0.0.1:2379",
+			wantAddr: "127.0.0.1:2379",
+		},
+		{
+			name:     "query string promoted to attributes",
+			ep:       "https://10.0.0.1:2379?weight=10&zone=us-east-1a",
+			wantAddr: "https://10.0.0.1:2379",
+			wantAttr: map[string]string{"weight": "10", "zone": "us-east-1a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := addrForEndpoint(tt.ep)
+			if addr.Addr != tt.wantAddr {
+				t.Fatalf("addrForEndpoint(%q).Addr = %q, want %q", tt.ep, addr.Addr, tt.wantAddr)
+			}
+			if tt.wantAttr == nil {
+				if addr.Attributes != nil {
+					t.Fatalf("addrForEndpoint(%q).Attributes = %v, want nil", tt.ep, addr.Attributes)
+				}
+				return
+			}
+			for k, v := range tt.wantAttr {
+				if got := addr.Attributes.Value(k); got != v {
+					t.Fatalf("addrForEndpoint(%q).Attributes.Value(%q) = %v, want %q", tt.ep, k, got, v)
+				}
+			}
+		})
+	}
+}
+
+// TestInitialEndpointsWithAttrsNoQuery guards against a nil-receiver panic in
+// addrsWithAttrs when an endpoint carries no query-string attributes of its own.
+func TestInitialEndpointsWithAttrsNoQuery(t *testing.T) {
+	r := &Resolver{clientId: "attrs-no-query"}
+	err := r.InitialEndpointsWithAttrs(map[string]Attributes{
+		"127.0.0.1:2379": {Region: "us-east-1", Weight: 5},
+	})
+	if err != nil {
+		t.Fatalf("InitialEndpointsWithAttrs returned error: %v", err)
+	}
+	if len(r.addrs) != 1 {
+		t.Fatalf("got %d addrs, want 1", len(r.addrs))
+	}
+	a, ok := AttributesFromAddress(r.addrs[0])
+	if !ok {
+		t.Fatalf("AttributesFromAddress found no Attributes on %+v", r.addrs[0])
+	}
+	if a.Region != "us-east-1" || a.Weight != 5 {
+		t.Fatalf("got Attributes %+v, want Region=us-east-1 Weight=5", a)
+	}
+}
+
+func TestSplitSRVEndpoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		eps         []string
+		wantStatics []string
+		wantSRV     string
+		wantErr     bool
+	}{
+		{
+			name:        "all static",
+			eps:         []string{"127.0.0.1:2379", "127.0.0.1:2380"},
+			wantStatics: []string{"127.0.0.1:2379", "127.0.0.1:2380"},
+		},
+		{
+			name:    "srv only",
+			eps:     []string{"dns+srv://_etcd-client-ssl._tcp.example.com"},
+			wantSRV: "_etcd-client-ssl._tcp.example.com",
+		},
+		{
+			name:        "mixed",
+			eps:         []string{"127.0.0.1:2379", "dns+srv://_etcd-client-ssl._tcp.example.com"},
+			wantStatics: []string{"127.0.0.1:2379"},
+			wantSRV:     "_etcd-client-ssl._tcp.example.com",
+		},
+		{
+			name:    "more than one srv name is rejected",
+			eps:     []string{"dns+srv://a.example.com", "dns+srv://b.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statics, srvName, err := splitSRVEndpoints(tt.eps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitSRVEndpoints(%v) error = %v, wantErr %v", tt.eps, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(statics, tt.wantStatics) {
+				t.Fatalf("splitSRVEndpoints(%v) statics = %v, want %v", tt.eps, statics, tt.wantStatics)
+			}
+			if srvName != tt.wantSRV {
+				t.Fatalf("splitSRVEndpoints(%v) srvName = %q, want %q", tt.eps, srvName, tt.wantSRV)
+			}
+		})
+	}
+}
+
+func TestSrvToAddr(t *testing.T) {
+	s := &net.SRV{Target: "etcd1.example.com.", Port: 2379, Priority: 10, Weight: 20}
+	addr := srvToAddr(s)
+	if want := "etcd1.example.com:2379"; addr.Addr != want {
+		t.Fatalf("srvToAddr(%+v).Addr = %q, want %q", s, addr.Addr, want)
+	}
+	if got := addr.Attributes.Value("priority"); got != "10" {
+		t.Fatalf("srvToAddr(%+v).Attributes.Value(\"priority\") = %v, want %q", s, got, "10")
+	}
+	if got := addr.Attributes.Value("weight"); got != "20" {
+		t.Fatalf("srvToAddr(%+v).Attributes.Value(\"weight\") = %v, want %q", s, got, "20")
+	}
+}
+
+// fakeCC is a minimal resolver.ClientConn that records UpdateState calls, enough to
+// exercise builder/Resolver lifetime without a real grpc dial.
+type fakeCC struct {
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (f *fakeCC) UpdateState(s resolver.State) error {
+	f.mu.Lock()
+	f.states = append(f.states, s)
+	f.mu.Unlock()
+	return nil
+}
+func (f *fakeCC) ReportError(error)                    {}
+func (f *fakeCC) NewAddress(addrs []resolver.Address)  {}
+func (f *fakeCC) NewServiceConfig(serviceConfig string) {}
+func (f *fakeCC) ParseServiceConfig(serviceConfigJSON string) *serviceconfig.ParseResult {
+	return nil
+}
+
+// TestBuilderRefCounting exercises the ref-counted acquire/release pairing added to
+// fix concurrent Builds tearing down one another's shared Resolver state.
+func TestBuilderRefCounting(t *testing.T) {
+	clientId := "refcount-test"
+	target := resolver.Target{Authority: clientId}
+
+	r1, err := bldr.Build(target, &fakeCC{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("first Build: %v", err)
+	}
+	r2, err := bldr.Build(target, &fakeCC{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("second Build: %v", err)
+	}
+	if r1 != r2 {
+		t.Fatalf("expected Build to reuse the same *Resolver for a shared clientId")
+	}
+
+	bldr.RLock()
+	count := bldr.refCounts[clientId]
+	bldr.RUnlock()
+	if count != 2 {
+		t.Fatalf("refCounts[%q] = %d, want 2", clientId, count)
+	}
+
+	r1.Close()
+
+	bldr.RLock()
+	_, stillRegistered := bldr.clientResolvers[clientId]
+	count = bldr.refCounts[clientId]
+	bldr.RUnlock()
+	if !stillRegistered {
+		t.Fatalf("resolver for %q was torn down while still held by a second Build", clientId)
+	}
+	if count != 1 {
+		t.Fatalf("refCounts[%q] = %d after one Close, want 1", clientId, count)
+	}
+
+	r2.Close()
+
+	bldr.RLock()
+	_, stillRegistered = bldr.clientResolvers[clientId]
+	bldr.RUnlock()
+	if stillRegistered {
+		t.Fatalf("resolver for %q was not torn down after its last Close", clientId)
+	}
+}
+
+// TestBuilderRefCountingConcurrent builds and closes the same clientId from many
+// goroutines at once; the registry should end up with no entry left over, and
+// concurrent Build calls must never drop below zero outstanding references.
+func TestBuilderRefCountingConcurrent(t *testing.T) {
+	clientId := "refcount-concurrent-test"
+	target := resolver.Target{Authority: clientId}
+
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			r, err := bldr.Build(target, &fakeCC{}, resolver.BuildOptions{})
+			if err != nil {
+				t.Errorf("Build: %v", err)
+				return
+			}
+			r.Close()
+		}()
+	}
+	wg.Wait()
+
+	bldr.RLock()
+	_, stillRegistered := bldr.clientResolvers[clientId]
+	count := bldr.refCounts[clientId]
+	bldr.RUnlock()
+	if stillRegistered || count != 0 {
+		t.Fatalf("clientResolvers/refCounts for %q leaked: registered=%v count=%d", clientId, stillRegistered, count)
+	}
+}
+
+// TestSRVWatchLifecycle exercises startSRVWatch/stopSRVWatch against an injected
+// lookup that blocks on its context, confirming that stopping the watch (via Close)
+// actually unblocks and retires the goroutine rather than leaking it, and that the
+// watch survives a Close() as long as another Build still holds the resolver, per
+// the refcounting semantics in TestBuilderRefCounting.
+func TestSRVWatchLifecycle(t *testing.T) {
+	clientId := "srv-watch-test"
+	target := resolver.Target{Authority: clientId}
+
+	called := make(chan struct{}, 1)
+	stopped := make(chan struct{})
+	lookup := func(ctx context.Context, name string) ([]resolver.Address, error) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		close(stopped)
+		return nil, ctx.Err()
+	}
+
+	r1, err := bldr.Build(target, &fakeCC{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("first Build: %v", err)
+	}
+	r := r1.(*Resolver)
+	r.Lock()
+	r.srvLookup = lookup
+	r.Unlock()
+	r.startSRVWatch("_etcd-client-ssl._tcp.example.com")
+
+	r2, err := bldr.Build(target, &fakeCC{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatalf("second Build: %v", err)
+	}
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("watchSRV never invoked the injected lookup")
+	}
+
+	r1.Close()
+	select {
+	case <-stopped:
+		t.Fatalf("SRV watch stopped after the first Close, but a second Build still holds the resolver")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r2.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("SRV watch's in-flight lookup was never unblocked by context cancellation after the last Close")
+	}
+}